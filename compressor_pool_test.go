@@ -0,0 +1,75 @@
+package main
+
+import (
+        "context"
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+)
+
+// testFileInfo returns the os.FileInfo for a small temp file, for tests
+// that need one to satisfy CompressorPool's job struct but don't care
+// about its content.
+func testFileInfo(t *testing.T) os.FileInfo {
+        t.Helper()
+        path := filepath.Join(t.TempDir(), "f.js")
+        if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+                t.Fatalf("WriteFile: %v", err)
+        }
+        info, err := os.Stat(path)
+        if err != nil {
+                t.Fatalf("Stat: %v", err)
+        }
+        return info
+}
+
+// TestCompressorPoolEnqueueUnknownCodecIsNoop checks the documented
+// behavior that Enqueue is a no-op for a codec the pool wasn't built
+// with, and that Cancel/Close still return promptly afterwards.
+func TestCompressorPoolEnqueueUnknownCodecIsNoop(t *testing.T) {
+        pool := NewCompressorPool(context.Background(), 1, nil, silentProgress{}, localSink{}, WithCodec("gzip", 0))
+        pool.Start(1)
+
+        pool.Enqueue("not-a-real-codec", "whatever.js", testFileInfo(t), "checksum")
+
+        pool.Cancel()
+        closed := make(chan struct{})
+        go func() {
+                pool.Close()
+                close(closed)
+        }()
+        select {
+        case <-closed:
+        case <-time.After(5 * time.Second):
+                t.Fatalf("Close() did not return after Cancel()")
+        }
+}
+
+// TestCompressorPoolCancelDrainsQueuedJobs checks that once Cancel is
+// called, a job enqueued afterwards neither blocks Enqueue nor keeps
+// the worker from draining the queue, so Close still returns rather
+// than hanging on a worker that's waiting for more jobs. It does not
+// observe whether doCompress ran for that job.
+func TestCompressorPoolCancelDrainsQueuedJobs(t *testing.T) {
+        pool := NewCompressorPool(context.Background(), 1, nil, silentProgress{}, localSink{}, WithCodec("gzip", 0))
+        pool.Start(1)
+        pool.Cancel()
+
+        // Enqueue after Cancel: per Enqueue's contract this either queues
+        // the job (which the worker then drains without compressing, since
+        // it checks p.ctx.Err() before calling doCompress) or returns
+        // immediately via the ctx.Done() case. Neither should block.
+        done := make(chan struct{})
+        go func() {
+                pool.Enqueue("gzip", "whatever.js", testFileInfo(t), "checksum")
+                pool.Close()
+                close(done)
+        }()
+
+        select {
+        case <-done:
+        case <-time.After(5 * time.Second):
+                t.Fatalf("Enqueue/Close after Cancel() did not return")
+        }
+}
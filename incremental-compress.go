@@ -2,42 +2,68 @@ package main
 
 import (
         "compress/gzip"
+        "context"
         "crypto/sha1"
+        "encoding/json"
         "flag"
         "fmt"
         "io"
         "io/fs"
         "log"
+        "math/rand"
+        "net"
+        "net/url"
         "os"
+        "os/exec"
+        "os/signal"
+        "path"
         "path/filepath"
+        "runtime"
+        "strconv"
         "strings"
         "sync"
+        "syscall"
         "time"
 
         "github.com/DataDog/zstd" // much better compression than "github.com/klauspost/compress/zstd"
         "github.com/andybalholm/brotli"
+        "github.com/aws/aws-sdk-go-v2/aws"
+        "github.com/aws/aws-sdk-go-v2/config"
+        "github.com/aws/aws-sdk-go-v2/service/s3"
+        "github.com/fsnotify/fsnotify"
+        "github.com/pkg/sftp"
+        "golang.org/x/crypto/ssh"
+        "golang.org/x/crypto/ssh/agent"
+        "golang.org/x/crypto/ssh/knownhosts"
         "zombiezen.com/go/sqlite"
         "zombiezen.com/go/sqlite/sqlitex"
 )
 
 var (
-        quietFlag         = flag.Bool("quiet", false, "Avoid printing status updates")
+        quietFlag         = flag.Bool("quiet", false, "Avoid printing status updates (equivalent to --progress=silent)")
+        progressFlag      = flag.String("progress", "tty", `Progress reporting style: "tty", "json", or "silent"`)
         verboseFlag       = flag.Bool("verbose", false, "Show status")
         dirFlag           = flag.String("dir", ".", "Directory to search for compressable files")
-        gzipFlag          = flag.Bool("gzip", true, "Compress with gzip")
-        gzipLevelFlag     = flag.Int("gzip_level", 9, "gzip compression level")
-        zstdFlag          = flag.Bool("zstd", true, "Compress with zstd")
-        zstdLevelFlag     = flag.Int("zstd_level", 19, "zstd compression level")
-        brotliFlag        = flag.Bool("brotli", true, "Compress with brotli")
-        brotliLevelFlag   = flag.Int("brotli_level", 11, "brotli compression level")
         typesFlag         = flag.String("types", "html,css,js,json,xml,ico,svg,md", "File types to compress, seperated by a comma")
         stateDirFlag      = flag.String("statedir", "", "Directory saving checksums and other state across runs")
         preserveMtimeFlag = flag.Bool("preserve_mtime", true, "Preserve mtime for files with the same checksum")
-
-        types   []string
-        logger  *log.Logger
-        failure = false
-        wg      sync.WaitGroup
+        concurrencyFlag   = flag.Int("concurrency", runtime.NumCPU(), "Number of concurrent workers per codec")
+        minRatioFlag      = flag.Float64("min_ratio", 0.95, "Skip compression if compressed_size/original_size exceeds this ratio")
+        minSizeFlag       = flag.Int64("min_size", 150, "Never compress source files smaller than this many bytes")
+        zstdDictFlag      = flag.String("zstd_dict", "", "Path to a pre-trained zstd dictionary to use for zstd compression")
+        zstdTrainDictFlag = flag.String("zstd_train_dict", "", "Instead of compressing, train a zstd dictionary from the discovered corpus and write it here")
+        destFlag          = flag.String("dest", "", `Where to store compressed output: empty for alongside the source files, "s3://bucket/prefix", or "sftp://user@host/path"`)
+        knownHostsFlag    = flag.String("known_hosts", "", "OpenSSH known_hosts file for verifying sftp host keys (defaults to $HOME/.ssh/known_hosts)")
+        codecsFlag        codecList
+
+        types  []string
+        logger *log.Logger
+
+        // failureMutex guards failure, which worker goroutines set when a
+        // file fails to compress; the run still exits non-zero, but other
+        // workers keep going instead of the whole process dying mid-run.
+        failureMutex sync.Mutex
+        failure      = false
 
         state                     = "Starting"
         countMutex                sync.Mutex
@@ -46,8 +72,172 @@ var (
         handledFileCount          = 0
         pendingFileCount          = 0
         checksummedCount          = 0
+
+        // connMutex guards all access to the shared sqlite.Conn, which is
+        // used both from the file-walking goroutine and from compressor
+        // workers recording skip markers.
+        connMutex sync.Mutex
 )
 
+// setFailure records that some file failed to process, without killing
+// the process: callers keep going so one bad file doesn't abort an
+// entire run. Checked at the end of the run to decide the exit code.
+func setFailure() {
+        failureMutex.Lock()
+        failure = true
+        failureMutex.Unlock()
+}
+
+func init() {
+        flag.Var(&codecsFlag, "codec", `Codec to enable, optionally with a level, e.g. "zstd:19" (repeatable; defaults to gzip, zstd and brotli at their default levels)`)
+}
+
+// Compressor is the interface implemented by each supported compression
+// codec. New codecs are added by implementing this interface and
+// registering an instance with RegisterCompressor.
+type Compressor interface {
+        // Name identifies the codec on the command line, e.g. "zstd".
+        Name() string
+        // Extension is the suffix appended to compressed output, e.g. ".zst".
+        Extension() string
+        // DefaultLevel is used when --codec doesn't specify one.
+        DefaultLevel() int
+        // NewWriter wraps w so that writes to it are compressed at level.
+        NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+        // NewReader wraps r so that reads from it are decompressed.
+        // Used by the verify subcommand.
+        NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// PoolableCompressor is implemented by codecs whose writers are
+// expensive enough to allocate that CompressorPool pools and reuses
+// them across files instead of allocating a new one per call.
+type PoolableCompressor interface {
+        Compressor
+        // ResetWriter returns a writer for w at level, reusing old (a
+        // previously-closed writer from this codec's pool) where
+        // possible. old is nil the first time a pool slot is used.
+        ResetWriter(old io.WriteCloser, w io.Writer, level int) (io.WriteCloser, error)
+}
+
+var registry = map[string]Compressor{}
+
+// RegisterCompressor makes a Compressor available by name to --codec.
+// Called from init() for the built-in codecs; other code in this
+// package can call it too, as long as it happens before flag.Parse.
+// This is package main, so packages outside it cannot call it.
+func RegisterCompressor(c Compressor) {
+        registry[c.Name()] = c
+}
+
+func init() {
+        RegisterCompressor(gzipCompressor{})
+        RegisterCompressor(zstdCompressor{})
+        RegisterCompressor(brotliCompressor{})
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string      { return "gzip" }
+func (gzipCompressor) Extension() string { return ".gz" }
+func (gzipCompressor) DefaultLevel() int { return 9 }
+func (gzipCompressor) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+        return gzip.NewWriterLevel(w, level)
+}
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+        return gzip.NewReader(r)
+}
+func (gzipCompressor) ResetWriter(old io.WriteCloser, w io.Writer, level int) (io.WriteCloser, error) {
+        if gw, ok := old.(*gzip.Writer); ok {
+                gw.Reset(w)
+                return gw, nil
+        }
+        return gzip.NewWriterLevel(w, level)
+}
+
+// zstdCompressor compresses with zstd, optionally against a
+// pre-trained dictionary (see --zstd_dict).
+type zstdCompressor struct {
+        dict []byte
+}
+
+func (zstdCompressor) Name() string      { return "zstd" }
+func (zstdCompressor) Extension() string { return ".zst" }
+func (zstdCompressor) DefaultLevel() int { return 19 }
+func (c zstdCompressor) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+        if len(c.dict) > 0 {
+                return zstd.NewWriterLevelDict(w, level, c.dict), nil
+        }
+        return zstd.NewWriterLevel(w, level), nil
+}
+func (c zstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+        if len(c.dict) > 0 {
+                return zstd.NewReaderDict(r, c.dict), nil
+        }
+        return zstd.NewReader(r), nil
+}
+
+// ResetWriter always allocates: DataDog/zstd's Writer doesn't expose a
+// public Reset, so there's no way to rebind an existing encoder to a
+// new destination. The pool slot still exists so zstd fits the same
+// CompressorPool.getWriter/putWriter path as gzip and brotli.
+func (c zstdCompressor) ResetWriter(old io.WriteCloser, w io.Writer, level int) (io.WriteCloser, error) {
+        return c.NewWriter(w, level)
+}
+
+type brotliCompressor struct{}
+
+func (brotliCompressor) Name() string      { return "brotli" }
+func (brotliCompressor) Extension() string { return ".br" }
+func (brotliCompressor) DefaultLevel() int { return 11 }
+func (brotliCompressor) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+        return brotli.NewWriterLevel(w, level), nil
+}
+func (brotliCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+        return io.NopCloser(brotli.NewReader(r)), nil
+}
+func (brotliCompressor) ResetWriter(old io.WriteCloser, w io.Writer, level int) (io.WriteCloser, error) {
+        if bw, ok := old.(*brotli.Writer); ok {
+                bw.Reset(w)
+                return bw, nil
+        }
+        return brotli.NewWriterLevel(w, level), nil
+}
+
+// codec is a single --codec flag value, e.g. "zstd:19".
+type codec struct {
+        name  string
+        level int // 0 means "use the codec's default level"
+}
+
+// codecList collects repeated --codec flags into flag.Value.
+type codecList []codec
+
+func (c *codecList) String() string {
+        parts := make([]string, len(*c))
+        for i, cc := range *c {
+                parts[i] = cc.name
+        }
+        return strings.Join(parts, ",")
+}
+
+func (c *codecList) Set(value string) error {
+        name, levelStr, hasLevel := strings.Cut(value, ":")
+        level := 0
+        if hasLevel {
+                l, err := strconv.Atoi(levelStr)
+                if err != nil {
+                        return fmt.Errorf("invalid level in --codec %q: %w", value, err)
+                }
+                level = l
+        }
+        if _, ok := registry[name]; !ok {
+                return fmt.Errorf("unknown codec %q", name)
+        }
+        *c = append(*c, codec{name: name, level: level})
+        return nil
+}
+
 func foundFile() {
         countMutex.Lock()
         totalFileCount++
@@ -56,7 +246,6 @@ func foundFile() {
 
 // Start processing a file.
 func start() {
-        wg.Add(1)
         countMutex.Lock()
         handledFileCount++
         pendingFileCount++
@@ -65,7 +254,6 @@ func start() {
 
 // Mark a file as complete.
 func done() {
-        wg.Done()
         countMutex.Lock()
         pendingFileCount--
         countMutex.Unlock()
@@ -83,195 +271,716 @@ func checksummed() {
         countMutex.Unlock()
 }
 
-// Compress a file using gzip, reusing the times and permissions of
-// the original file.
-func doGzip(path string, info fs.FileInfo) {
-        defer done()
-        outpath := path + ".gz"
+// job describes a single file queued for compression with one codec.
+type job struct {
+        path     string
+        info     fs.FileInfo
+        checksum string
+}
 
-        if *verboseFlag {
-                logger.Printf("gzip %q", path)
+// enabledCodec pairs a registered Compressor with the level it was
+// enabled at.
+type enabledCodec struct {
+        compressor Compressor
+        level      int
+}
+
+// CompressorOption configures a CompressorPool at construction time.
+type CompressorOption func(*CompressorPool)
+
+// WithCodec enables a registered codec by name. A level of 0 uses the
+// codec's DefaultLevel.
+func WithCodec(name string, level int) CompressorOption {
+        return func(p *CompressorPool) {
+                c, ok := registry[name]
+                if !ok {
+                        logger.Fatalf("Unknown codec %q", name)
+                }
+                if level == 0 {
+                        level = c.DefaultLevel()
+                }
+                p.codecs[name] = enabledCodec{compressor: c, level: level}
         }
+}
 
-        reader, err := os.Open(path)
+// Sink is the destination compressed output is written to. relPath is
+// always the path of the compressed file as reached by walking --dir,
+// so it begins with --dir itself unless --dir is "." (matching the
+// layout of the source tree); implementations are responsible for
+// mapping that onto wherever they actually store bytes. Put must be
+// atomic from the point of view of Stat: a reader calling Stat must
+// never observe a partially-written file.
+type Sink interface {
+        // Put stores r's content at relPath, recording mtime and mode
+        // on the destination when the backing store supports it.
+        Put(ctx context.Context, relPath string, r io.Reader, mtime time.Time, mode fs.FileMode) error
+
+        // Stat returns the size and mtime of relPath, or an error if
+        // it doesn't exist.
+        Stat(ctx context.Context, relPath string) (size int64, mtime time.Time, err error)
+
+        // Open returns the content at relPath for reading. Used by the
+        // verify subcommand to decompress and checksum compressed
+        // output, wherever it actually lives.
+        Open(ctx context.Context, relPath string) (io.ReadCloser, error)
+
+        // Delete removes relPath. Used by the prune subcommand to clean
+        // up compressed output whose source file is gone.
+        Delete(ctx context.Context, relPath string) error
+
+        // List returns the relPath of every object stored under dir
+        // ("" for everything), so the prune subcommand can enumerate
+        // compressed output without assuming it lives alongside the
+        // source tree on local disk.
+        List(ctx context.Context, dir string) ([]string, error)
+}
+
+// parseSink builds the Sink named by --dest: empty for the local
+// filesystem (the historical behavior), or an "s3://" or "sftp://" URL
+// for a remote destination.
+func parseSink(dest string) (Sink, error) {
+        switch {
+        case dest == "":
+                return localSink{}, nil
+        case strings.HasPrefix(dest, "s3://"):
+                return newS3Sink(dest)
+        case strings.HasPrefix(dest, "sftp://"):
+                return newSFTPSink(dest)
+        default:
+                return nil, fmt.Errorf(`unrecognized --dest %q (want "", "s3://bucket/prefix", or "sftp://user@host/path")`, dest)
+        }
+}
+
+// localSink stores compressed output directly in the source tree,
+// exactly as incremental-compress has always done.
+type localSink struct{}
+
+// Put writes content to relPath via a temp-file-plus-rename, same as
+// the rest of this package. As an optimization, if r is itself an
+// *os.File (the common case: doCompress's own candidate file, already
+// on local disk), Put renames it directly instead of copying its
+// content again.
+func (localSink) Put(ctx context.Context, relPath string, r io.Reader, mtime time.Time, mode fs.FileMode) error {
+        if f, ok := r.(*os.File); ok {
+                if err := os.Chtimes(f.Name(), mtime, mtime); err == nil {
+                        if err := os.Chmod(f.Name(), mode); err == nil {
+                                if err := os.Rename(f.Name(), relPath); err == nil {
+                                        return nil
+                                }
+                        }
+                }
+        }
+
+        tmpPath := fmt.Sprintf("%s.tmp-%d-%d", relPath, os.Getpid(), rand.Int63())
+        out, err := os.Create(tmpPath)
         if err != nil {
-                logger.Fatalf("Could not open %q for reading: %v", path, err)
-                failure = true
-                return
+                return err
         }
-        defer reader.Close()
+        defer out.Close()
+        if _, err := io.Copy(out, r); err != nil {
+                os.Remove(tmpPath)
+                return err
+        }
+        if err := out.Sync(); err != nil {
+                os.Remove(tmpPath)
+                return err
+        }
+        if err := os.Chtimes(tmpPath, mtime, mtime); err != nil {
+                os.Remove(tmpPath)
+                return err
+        }
+        if err := os.Chmod(tmpPath, mode); err != nil {
+                os.Remove(tmpPath)
+                return err
+        }
+        return os.Rename(tmpPath, relPath)
+}
 
-        outfile, err := os.Create(outpath)
+func (localSink) Stat(ctx context.Context, relPath string) (int64, time.Time, error) {
+        info, err := os.Stat(relPath)
         if err != nil {
-                logger.Fatalf("Could not open %q for writing: %v", outpath, err)
-                failure = true
-                return
+                return 0, time.Time{}, err
         }
-        defer outfile.Close()
+        return info.Size(), info.ModTime(), nil
+}
+
+func (localSink) Open(ctx context.Context, relPath string) (io.ReadCloser, error) {
+        return os.Open(relPath)
+}
+
+func (localSink) Delete(ctx context.Context, relPath string) error {
+        return os.Remove(relPath)
+}
+
+func (localSink) List(ctx context.Context, dir string) ([]string, error) {
+        if dir == "" {
+                dir = "."
+        }
+        var out []string
+        err := filepath.Walk(dir, func(p string, info fs.FileInfo, err error) error {
+                if err != nil || info.IsDir() {
+                        return nil
+                }
+                out = append(out, p)
+                return nil
+        })
+        return out, err
+}
 
-        writer, err := gzip.NewWriterLevel(outfile, *gzipLevelFlag)
+// s3Sink stores compressed output as objects in an S3 bucket, under a
+// fixed key prefix. Since S3 has no mtime of its own, the original
+// mtime is stashed in object metadata and consulted (in preference to
+// LastModified) by Stat.
+type s3Sink struct {
+        client *s3.Client
+        bucket string
+        prefix string
+}
+
+func newS3Sink(dest string) (Sink, error) {
+        u, err := url.Parse(dest)
         if err != nil {
-                logger.Fatalf("Could not create gzip writer for %q: %v", path, err)
-                failure = true
-                return
+                return nil, fmt.Errorf("invalid --dest %q: %w", dest, err)
         }
-        _, err = io.Copy(writer, reader)
+        cfg, err := config.LoadDefaultConfig(context.Background())
         if err != nil {
-                logger.Fatalf("Could not copy data for %q: %v", path, err)
-                failure = true
-                return
+                return nil, fmt.Errorf("could not load AWS config: %w", err)
         }
-        writer.Close() // force a flush
+        return &s3Sink{
+                client: s3.NewFromConfig(cfg),
+                bucket: u.Host,
+                prefix: strings.TrimPrefix(u.Path, "/"),
+        }, nil
+}
+
+func (s *s3Sink) key(relPath string) string {
+        return path.Join(s.prefix, relPath)
+}
 
-        err = os.Chtimes(outpath, info.ModTime(), info.ModTime())
+func (s *s3Sink) Put(ctx context.Context, relPath string, r io.Reader, mtime time.Time, mode fs.FileMode) error {
+        _, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+                Bucket: aws.String(s.bucket),
+                Key:    aws.String(s.key(relPath)),
+                Body:   r,
+                Metadata: map[string]string{
+                        "mtime": strconv.FormatInt(mtime.Unix(), 10),
+                        "mode":  strconv.FormatUint(uint64(mode), 8),
+                },
+        })
+        return err
+}
+
+func (s *s3Sink) Stat(ctx context.Context, relPath string) (int64, time.Time, error) {
+        out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+                Bucket: aws.String(s.bucket),
+                Key:    aws.String(s.key(relPath)),
+        })
         if err != nil {
-                logger.Fatalf("Could not update times for %q: %v", outpath, err)
-                failure = true
-                return
+                return 0, time.Time{}, err
+        }
+        mtime := aws.ToTime(out.LastModified)
+        if v, ok := out.Metadata["mtime"]; ok {
+                if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+                        mtime = time.Unix(unix, 0)
+                }
         }
+        return aws.ToInt64(out.ContentLength), mtime, nil
+}
 
-        err = os.Chmod(outpath, info.Mode())
+func (s *s3Sink) Open(ctx context.Context, relPath string) (io.ReadCloser, error) {
+        out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+                Bucket: aws.String(s.bucket),
+                Key:    aws.String(s.key(relPath)),
+        })
         if err != nil {
-                logger.Fatalf("Could not update modes for %q: %v", outpath, err)
-                failure = true
-                return
+                return nil, err
         }
+        return out.Body, nil
+}
 
-        compressed()
+func (s *s3Sink) Delete(ctx context.Context, relPath string) error {
+        _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+                Bucket: aws.String(s.bucket),
+                Key:    aws.String(s.key(relPath)),
+        })
+        return err
 }
 
-// Compress a file using zstd, reusing the times and permissions of
-// the original file.
-func doZstd(path string, info fs.FileInfo) {
-        defer done()
-        outpath := path + ".zst"
+// List returns every object under dir, relative to s.prefix (not
+// including it), by paginating ListObjectsV2.
+func (s *s3Sink) List(ctx context.Context, dir string) ([]string, error) {
+        prefix := s.key(dir)
+        if prefix == "." {
+                prefix = ""
+        }
+        if prefix != "" && !strings.HasSuffix(prefix, "/") {
+                prefix += "/"
+        }
 
-        if *verboseFlag {
-                logger.Printf("zstd %q", path)
+        var out []string
+        paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+                Bucket: aws.String(s.bucket),
+                Prefix: aws.String(prefix),
+        })
+        for paginator.HasMorePages() {
+                page, err := paginator.NextPage(ctx)
+                if err != nil {
+                        return nil, err
+                }
+                for _, obj := range page.Contents {
+                        rel := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+                        out = append(out, strings.TrimPrefix(rel, "/"))
+                }
         }
+        return out, nil
+}
 
-        reader, err := os.Open(path)
+// sftpSink stores compressed output under a fixed root directory on a
+// remote host, reached over SSH using the local ssh-agent for auth
+// (the same mechanism git and rsync use, so it needs no extra flags).
+type sftpSink struct {
+        client *sftp.Client
+        root   string
+}
+
+func newSFTPSink(dest string) (Sink, error) {
+        u, err := url.Parse(dest)
         if err != nil {
-                logger.Fatalf("Could not open %q for reading: %v", path, err)
-                failure = true
-                return
+                return nil, fmt.Errorf("invalid --dest %q: %w", dest, err)
         }
-        defer reader.Close()
 
-        outfile, err := os.Create(outpath)
+        auth, err := sftpAgentAuth()
         if err != nil {
-                logger.Fatalf("Could not open %q for writing: %v", outpath, err)
-                failure = true
-                return
+                return nil, err
         }
-        defer outfile.Close()
 
-        writer := zstd.NewWriterLevel(outfile, *zstdLevelFlag)
+        hostKeyCallback, err := sftpHostKeyCallback()
+        if err != nil {
+                return nil, err
+        }
 
-        _, err = io.Copy(writer, reader)
+        addr := u.Host
+        if !strings.Contains(addr, ":") {
+                addr += ":22"
+        }
+        conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+                User:            u.User.Username(),
+                Auth:            []ssh.AuthMethod{auth},
+                HostKeyCallback: hostKeyCallback,
+        })
         if err != nil {
-                logger.Fatalf("Could not copy data for %q: %v", path, err)
-                failure = true
-                return
+                return nil, fmt.Errorf("could not connect to %q: %w", addr, err)
         }
-        writer.Close() // force a flush
 
-        err = os.Chtimes(outpath, info.ModTime(), info.ModTime())
+        client, err := sftp.NewClient(conn)
         if err != nil {
-                logger.Fatalf("Could not update times for %q: %v", outpath, err)
-                failure = true
-                return
+                conn.Close()
+                return nil, fmt.Errorf("could not start sftp session on %q: %w", addr, err)
         }
 
-        err = os.Chmod(outpath, info.Mode())
+        return &sftpSink{client: client, root: u.Path}, nil
+}
+
+func sftpAgentAuth() (ssh.AuthMethod, error) {
+        sock := os.Getenv("SSH_AUTH_SOCK")
+        if sock == "" {
+                return nil, fmt.Errorf("SSH_AUTH_SOCK is not set; sftp destinations need a running ssh-agent")
+        }
+        conn, err := net.Dial("unix", sock)
+        if err != nil {
+                return nil, fmt.Errorf("could not connect to ssh-agent: %w", err)
+        }
+        return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), nil
+}
+
+// sftpHostKeyCallback builds a HostKeyCallback that verifies the
+// remote host key against --known_hosts (or $HOME/.ssh/known_hosts if
+// unset), the same file ssh/scp/rsync already trust entries in.
+func sftpHostKeyCallback() (ssh.HostKeyCallback, error) {
+        path := *knownHostsFlag
+        if path == "" {
+                home, err := os.UserHomeDir()
+                if err != nil {
+                        return nil, fmt.Errorf("could not determine $HOME for a default --known_hosts: %w", err)
+                }
+                path = filepath.Join(home, ".ssh", "known_hosts")
+        }
+        callback, err := knownhosts.New(path)
+        if err != nil {
+                return nil, fmt.Errorf("could not load known_hosts file %q (pass --known_hosts to use a different one): %w", path, err)
+        }
+        return callback, nil
+}
+
+func (s *sftpSink) path(relPath string) string {
+        return path.Join(s.root, relPath)
+}
+
+func (s *sftpSink) Put(ctx context.Context, relPath string, r io.Reader, mtime time.Time, mode fs.FileMode) error {
+        full := s.path(relPath)
+        if err := s.client.MkdirAll(path.Dir(full)); err != nil {
+                return err
+        }
+
+        tmp := fmt.Sprintf("%s.tmp-%d-%d", full, os.Getpid(), rand.Int63())
+        f, err := s.client.Create(tmp)
+        if err != nil {
+                return err
+        }
+        if _, err := io.Copy(f, r); err != nil {
+                f.Close()
+                s.client.Remove(tmp)
+                return err
+        }
+        if err := f.Close(); err != nil {
+                s.client.Remove(tmp)
+                return err
+        }
+        if err := s.client.Chtimes(tmp, mtime, mtime); err != nil {
+                s.client.Remove(tmp)
+                return err
+        }
+        if err := s.client.Chmod(tmp, mode); err != nil {
+                s.client.Remove(tmp)
+                return err
+        }
+        return s.client.PosixRename(tmp, full)
+}
+
+func (s *sftpSink) Stat(ctx context.Context, relPath string) (int64, time.Time, error) {
+        info, err := s.client.Stat(s.path(relPath))
         if err != nil {
-                logger.Fatalf("Could not update modes for %q: %v", outpath, err)
-                failure = true
+                return 0, time.Time{}, err
+        }
+        return info.Size(), info.ModTime(), nil
+}
+
+func (s *sftpSink) Open(ctx context.Context, relPath string) (io.ReadCloser, error) {
+        return s.client.Open(s.path(relPath))
+}
+
+func (s *sftpSink) Delete(ctx context.Context, relPath string) error {
+        return s.client.Remove(s.path(relPath))
+}
+
+// List returns every regular file under dir, relative to s.root.
+func (s *sftpSink) List(ctx context.Context, dir string) ([]string, error) {
+        var out []string
+        walker := s.client.Walk(s.path(dir))
+        for walker.Step() {
+                if err := walker.Err(); err != nil {
+                        return nil, err
+                }
+                if walker.Stat().IsDir() {
+                        continue
+                }
+                rel, err := filepath.Rel(s.root, walker.Path())
+                if err != nil {
+                        return nil, err
+                }
+                out = append(out, filepath.ToSlash(rel))
+        }
+        return out, nil
+}
+
+// CompressorPool runs a bounded set of workers per codec, so that slow
+// brotli jobs can't starve gzip or zstd (or each other) and so that a
+// burst of discovered files doesn't spawn unbounded goroutines.
+// Queueing blocks once a codec's queue is full, which applies
+// backpressure back to the caller (normally walkFile).
+type CompressorPool struct {
+        ctx    context.Context
+        cancel context.CancelFunc
+
+        conn     *sqlite.Conn
+        progress Progress
+        sink     Sink
+        codecs   map[string]enabledCodec
+        queues   map[string]chan job
+        forced   map[string]bool
+
+        // writerPools holds, per codec, previously-used writers for
+        // PoolableCompressor codecs (notably brotli, whose high-level
+        // encoders are expensive to allocate). doCompress takes and
+        // returns writers through it on every run; watch mode gains
+        // the most, since the same codecs are invoked repeatedly for
+        // the life of the process.
+        writerPools map[string]*sync.Pool
+
+        workers sync.WaitGroup
+}
+
+// NewCompressorPool creates a pool with concurrency workers per codec
+// enabled via opts, and a queue of the same depth per codec, so at most
+// one pending job per worker is buffered before Enqueue starts
+// blocking. conn may be nil, in which case no state is persisted across
+// runs. sink receives the compressed output; pass localSink{} for the
+// historical alongside-the-source-files behavior.
+func NewCompressorPool(ctx context.Context, concurrency int, conn *sqlite.Conn, progress Progress, sink Sink, opts ...CompressorOption) *CompressorPool {
+        p := &CompressorPool{
+                conn:        conn,
+                progress:    progress,
+                sink:        sink,
+                codecs:      make(map[string]enabledCodec),
+                queues:      make(map[string]chan job),
+                forced:      make(map[string]bool),
+                writerPools: make(map[string]*sync.Pool),
+        }
+        for _, opt := range opts {
+                opt(p)
+        }
+        for name := range p.codecs {
+                p.queues[name] = make(chan job, concurrency)
+                p.writerPools[name] = &sync.Pool{}
+        }
+        p.ctx, p.cancel = context.WithCancel(ctx)
+        return p
+}
+
+// getWriter returns a writer for c at level writing to w, reusing a
+// previously-returned writer from this codec's pool when c implements
+// PoolableCompressor and one is available.
+func (p *CompressorPool) getWriter(name string, c Compressor, level int, w io.Writer) (io.WriteCloser, error) {
+        pc, ok := c.(PoolableCompressor)
+        if !ok {
+                return c.NewWriter(w, level)
+        }
+        var old io.WriteCloser
+        if v := p.writerPools[name].Get(); v != nil {
+                old = v.(io.WriteCloser)
+        }
+        return pc.ResetWriter(old, w, level)
+}
+
+// putWriter returns a writer obtained from getWriter to its codec's
+// pool once the caller is done with it.
+func (p *CompressorPool) putWriter(name string, writer io.WriteCloser) {
+        if _, ok := p.codecs[name].compressor.(PoolableCompressor); ok {
+                p.writerPools[name].Put(writer)
+        }
+}
+
+// Codecs returns the names of the codecs enabled on this pool.
+func (p *CompressorPool) Codecs() []string {
+        names := make([]string, 0, len(p.codecs))
+        for name := range p.codecs {
+                names = append(names, name)
+        }
+        return names
+}
+
+// Extension returns the output file suffix for an enabled codec.
+func (p *CompressorPool) Extension(name string) string {
+        return p.codecs[name].compressor.Extension()
+}
+
+// Force marks a codec as needing recompression regardless of per-file
+// staleness checks, e.g. because its zstd dictionary changed.
+func (p *CompressorPool) Force(name string) {
+        p.forced[name] = true
+}
+
+// Forced reports whether Force was called for this codec.
+func (p *CompressorPool) Forced(name string) bool {
+        return p.forced[name]
+}
+
+// Start launches concurrency workers for each enabled codec.
+func (p *CompressorPool) Start(concurrency int) {
+        for name, ec := range p.codecs {
+                for i := 0; i < concurrency; i++ {
+                        p.workers.Add(1)
+                        go p.worker(name, ec)
+                }
+        }
+}
+
+func (p *CompressorPool) worker(name string, ec enabledCodec) {
+        defer p.workers.Done()
+        for j := range p.queues[name] {
+                if p.ctx.Err() != nil {
+                        done()
+                        continue
+                }
+                doCompress(p, name, ec.compressor, ec.level, j.path, j.info, j.checksum)
+        }
+}
+
+// Enqueue blocks until the named codec's queue has room, or the pool's
+// context is canceled. It is a no-op if the codec isn't enabled.
+func (p *CompressorPool) Enqueue(name string, path string, info fs.FileInfo, checksum string) {
+        queue, ok := p.queues[name]
+        if !ok {
                 return
         }
-        compressed()
+        start()
+        select {
+        case queue <- job{path, info, checksum}:
+        case <-p.ctx.Done():
+                done()
+        }
+}
+
+// Cancel stops workers from picking up any more queued jobs. In-flight
+// jobs are allowed to finish; already-queued jobs are drained and
+// counted as done without being compressed.
+func (p *CompressorPool) Cancel() {
+        p.cancel()
+}
+
+// Close closes the job queues, signalling that no more jobs will be
+// enqueued, and waits for all workers to drain and exit.
+func (p *CompressorPool) Close() {
+        for _, queue := range p.queues {
+                close(queue)
+        }
+        p.workers.Wait()
 }
 
-// Compress a file using brotli, reusing the times and permissions of
-// the original file.
-func doBrotli(path string, info fs.FileInfo) {
+// doCompress compresses path with c at the given level, reusing the
+// times and permissions of the original file, and hands the result to
+// pool's sink. If the result isn't meaningfully smaller than the
+// source (per min_size/min_ratio), the candidate is discarded and a
+// do-not-compress marker is recorded for codecName/checksum so future
+// runs skip it without recompressing.
+func doCompress(pool *CompressorPool, codecName string, c Compressor, level int, path string, info fs.FileInfo, checksum string) {
         defer done()
-        outpath := path + ".br"
+        conn, progress, sink := pool.conn, pool.progress, pool.sink
+        begin := time.Now()
+        outpath := path + c.Extension()
+
+        if info.Size() < *minSizeFlag {
+                if *verboseFlag {
+                        logger.Printf("Skipping %s %q: %d bytes is below min_size", c.Name(), path, info.Size())
+                }
+                markSkipCompression(conn, path, codecName, checksum)
+                progress.FileDone(codecName, path, info.Size(), 0, time.Since(begin), true)
+                return
+        }
 
         if *verboseFlag {
-                fmt.Printf("zstd %q\n", path)
+                logger.Printf("%s %q", c.Name(), path)
         }
 
         reader, err := os.Open(path)
         if err != nil {
-                logger.Fatalf("Could not open %q for reading: %v", path, err)
-                failure = true
+                logger.Printf("Could not open %q for reading: %v", path, err)
+                setFailure()
                 return
         }
         defer reader.Close()
 
-        outfile, err := os.Create(outpath)
+        candidatePath := fmt.Sprintf("%s.tmp-%d-%d", outpath, os.Getpid(), rand.Int63())
+        outfile, err := os.Create(candidatePath)
         if err != nil {
-                logger.Fatalf("Could not open %q for writing: %v", outpath, err)
-                failure = true
+                logger.Printf("Could not open %q for writing: %v", candidatePath, err)
+                setFailure()
                 return
         }
         defer outfile.Close()
 
-        writer := brotli.NewWriterLevel(outfile, *brotliLevelFlag)
+        counter := &countingWriter{w: outfile}
+        writer, err := pool.getWriter(codecName, c, level, counter)
+        if err != nil {
+                logger.Printf("Could not create %s writer for %q: %v", c.Name(), path, err)
+                os.Remove(candidatePath)
+                setFailure()
+                return
+        }
 
-        _, err = io.Copy(writer, reader)
+        in, err := io.Copy(writer, reader)
         if err != nil {
-                logger.Fatalf("Could not copy data for %q: %v", path, err)
-                failure = true
+                logger.Printf("Could not copy data for %q: %v", path, err)
+                os.Remove(candidatePath)
+                setFailure()
                 return
         }
         writer.Close() // force a flush
+        pool.putWriter(codecName, writer)
+        out := counter.n
+
+        // fsync before rename, so a crash never leaves a renamed-but-not
+        // -flushed (and thus truncated) file in outpath's place.
+        if err := outfile.Sync(); err != nil {
+                logger.Printf("Could not sync %q: %v", candidatePath, err)
+                os.Remove(candidatePath)
+                setFailure()
+                return
+        }
 
-        err = os.Chtimes(outpath, info.ModTime(), info.ModTime())
-        if err != nil {
-                logger.Fatalf("Could not update times for %q: %v", outpath, err)
-                failure = true
+        if ratio := float64(out) / float64(in); ratio > *minRatioFlag {
+                if *verboseFlag {
+                        logger.Printf("Discarding %s %q: ratio %.2f exceeds min_ratio %.2f", c.Name(), path, ratio, *minRatioFlag)
+                }
+                os.Remove(candidatePath)
+                markSkipCompression(conn, path, codecName, checksum)
+                progress.FileDone(codecName, path, in, out, time.Since(begin), true)
                 return
         }
 
-        err = os.Chmod(outpath, info.Mode())
-        if err != nil {
-                logger.Fatalf("Could not update modes for %q: %v", outpath, err)
-                failure = true
+        if _, err := outfile.Seek(0, io.SeekStart); err != nil {
+                logger.Printf("Could not seek %q: %v", candidatePath, err)
+                os.Remove(candidatePath)
+                setFailure()
                 return
         }
+
+        if err := sink.Put(pool.ctx, outpath, outfile, info.ModTime(), info.Mode()); err != nil {
+                logger.Printf("Could not store %q: %v", outpath, err)
+                os.Remove(candidatePath)
+                setFailure()
+                return
+        }
+
+        // localSink's Put renames candidatePath away on success, so this
+        // is a harmless no-op there; for sinks that stream-read outfile
+        // instead (s3Sink, sftpSink), candidatePath is otherwise never
+        // cleaned up once its content is safely stored remotely.
+        os.Remove(candidatePath)
+
+        clearSkipCompression(conn, path, codecName)
+        recordStats(conn, codecName, in, out)
         compressed()
+        progress.FileDone(codecName, path, in, out, time.Since(begin), false)
 }
 
 // Process a single file.  Used as a callback (indirectly) from filepath.Walk.
-func walkFile(conn *sqlite.Conn, path string, info fs.FileInfo, err error) error {
+func walkFile(pool *CompressorPool, conn *sqlite.Conn, path string, info fs.FileInfo, err error) error {
         if info.IsDir() {
                 return nil
         }
 
+        if isCompressableType(path) {
+                foundFile()
+                return maybeCompressFile(pool, conn, path, info)
+        }
+        return nil
+}
+
+// isCompressableType reports whether path ends in one of --types'
+// extensions.
+func isCompressableType(path string) bool {
         for _, fileType := range types {
                 if strings.HasSuffix(path, "."+fileType) {
-                        foundFile()
-                        return maybeCompressFile(conn, path, info)
-                        //return nil
+                        return true
                 }
         }
-        return nil
+        return false
 }
 
 // Check a compressed file to see if it needs to be rebuilt.
-func checkCompressedFile(conn *sqlite.Conn, path string, info fs.FileInfo, extension string) bool {
-        compressed, err := os.Stat(path + extension)
+func checkCompressedFile(ctx context.Context, sink Sink, path string, info fs.FileInfo, extension string) bool {
+        _, mtime, err := sink.Stat(ctx, path+extension)
 
-        if err != nil || compressed.ModTime().Before(info.ModTime()) {
+        if err != nil || mtime.Before(info.ModTime()) {
                 return true
         }
         return false
 }
 
-// Check a source file to see if it needs to be rebuilt
-func checkSourceFile(conn *sqlite.Conn, path string, info fs.FileInfo) bool {
+// Check a source file to see if it needs to be rebuilt, returning
+// whether it's changed since the last run and its current checksum.
+func checkSourceFile(conn *sqlite.Conn, path string, info fs.FileInfo) (bool, string) {
         if conn != nil {
                 sha := sha1.New()
 
@@ -285,6 +994,9 @@ func checkSourceFile(conn *sqlite.Conn, path string, info fs.FileInfo) bool {
                 checksum := fmt.Sprintf("%x", sha.Sum(nil))
                 checksummed()
 
+                connMutex.Lock()
+                defer connMutex.Unlock()
+
                 stmt, err := conn.Prepare("select mtime from checksumstate where checksum=$checksum and filename=$filename;")
                 if err != nil {
                         panic(err)
@@ -328,7 +1040,7 @@ func checkSourceFile(conn *sqlite.Conn, path string, info fs.FileInfo) bool {
                         if err != nil {
                                 panic(err)
                         }
-                        return true
+                        return true, checksum
                 }
 
                 if mtime != info.ModTime() {
@@ -340,45 +1052,829 @@ func checkSourceFile(conn *sqlite.Conn, path string, info fs.FileInfo) bool {
                                 panic(err)
                         }
                 }
+                return false, checksum
+        }
+        return false, ""
+}
+
+// shouldSkipCompression reports whether path was already found, at this
+// checksum, to compress worse than min_ratio/min_size for the given
+// codec. Returns false (never skip) when conn is nil, since there's no
+// state to remember it in.
+func shouldSkipCompression(conn *sqlite.Conn, path, codecName, checksum string) bool {
+        if conn == nil {
                 return false
         }
-        return false
+
+        connMutex.Lock()
+        defer connMutex.Unlock()
+
+        var skip bool
+        err := sqlitex.ExecuteTransient(
+                conn,
+                "select 1 from skipstate where filename=? and codec=? and checksum=?;",
+                &sqlitex.ExecOptions{
+                        Args: []any{path, codecName, checksum},
+                        ResultFunc: func(stmt *sqlite.Stmt) error {
+                                skip = true
+                                return nil
+                        },
+                },
+        )
+        if err != nil {
+                panic(err)
+        }
+        return skip
 }
 
-func maybeCompressFile(conn *sqlite.Conn, path string, info fs.FileInfo) error {
-        forceRecompress := checkSourceFile(conn, path, info)
-        info, _ = os.Stat(path)
+// markSkipCompression records that path doesn't compress well enough
+// with codecName at this checksum, so future runs can skip it without
+// re-compressing.
+func markSkipCompression(conn *sqlite.Conn, path, codecName, checksum string) {
+        if conn == nil {
+                return
+        }
 
-        if *gzipFlag && (forceRecompress || checkCompressedFile(conn, path, info, ".gz")) {
-                start()
-                go doGzip(path, info)
+        connMutex.Lock()
+        defer connMutex.Unlock()
+
+        err := sqlitex.ExecuteTransient(
+                conn,
+                "insert or replace into skipstate values (?, ?, ?);",
+                &sqlitex.ExecOptions{
+                        Args: []any{path, codecName, checksum},
+                },
+        )
+        if err != nil {
+                panic(err)
         }
-        if *zstdFlag && (forceRecompress || checkCompressedFile(conn, path, info, ".zst")) {
-                start()
-                go doZstd(path, info)
+}
+
+// clearSkipCompression removes any stale do-not-compress marker once a
+// file successfully compresses again.
+func clearSkipCompression(conn *sqlite.Conn, path, codecName string) {
+        if conn == nil {
+                return
         }
-        if *brotliFlag && (forceRecompress || checkCompressedFile(conn, path, info, ".br")) {
-                start()
-                go doBrotli(path, info)
+
+        connMutex.Lock()
+        defer connMutex.Unlock()
+
+        err := sqlitex.ExecuteTransient(
+                conn,
+                "delete from skipstate where filename=? and codec=?;",
+                &sqlitex.ExecOptions{
+                        Args: []any{path, codecName},
+                },
+        )
+        if err != nil {
+                panic(err)
+        }
+}
+
+// recordStats adds in/out bytes and a file count to codecName's
+// running totals, for the stats subcommand to report later.
+func recordStats(conn *sqlite.Conn, codecName string, in, out int64) {
+        if conn == nil {
+                return
+        }
+
+        connMutex.Lock()
+        defer connMutex.Unlock()
+
+        err := sqlitex.ExecuteTransient(
+                conn,
+                `insert into statsstate(codec, files, bytes_in, bytes_out) values (?, 1, ?, ?)
+                 on conflict(codec) do update set
+                   files=files+1, bytes_in=bytes_in+excluded.bytes_in, bytes_out=bytes_out+excluded.bytes_out;`,
+                &sqlitex.ExecOptions{
+                        Args: []any{codecName, in, out},
+                },
+        )
+        if err != nil {
+                panic(err)
+        }
+}
+
+// dictChanged compares dict's checksum against the one a codec was
+// last run with, persists the new checksum, and reports whether they
+// differed (and so every existing output for that codec is stale).
+func dictChanged(conn *sqlite.Conn, codecName string, dict []byte) bool {
+        if conn == nil {
+                return false
+        }
+
+        sha := fmt.Sprintf("%x", sha1.Sum(dict))
+
+        connMutex.Lock()
+        defer connMutex.Unlock()
+
+        changed := true
+        err := sqlitex.ExecuteTransient(
+                conn,
+                "select sha from dictstate where codec=?;",
+                &sqlitex.ExecOptions{
+                        Args: []any{codecName},
+                        ResultFunc: func(stmt *sqlite.Stmt) error {
+                                changed = stmt.GetText("sha") != sha
+                                return nil
+                        },
+                },
+        )
+        if err != nil {
+                panic(err)
+        }
+
+        if changed {
+                err = sqlitex.ExecuteTransient(
+                        conn,
+                        "insert or replace into dictstate values (?, ?);",
+                        &sqlitex.ExecOptions{
+                                Args: []any{codecName, sha},
+                        },
+                )
+                if err != nil {
+                        panic(err)
+                }
+        }
+        return changed
+}
+
+// cleanupTempFiles removes leftover "*.tmp-<pid>-<rand>" files under
+// dir, left behind when a prior run was killed (or crashed) between
+// creating a candidate and renaming it into place. Called once at
+// startup, before any subcommand walks dir, since a graceful shutdown
+// never leaves these behind in the first place: doCompress isn't
+// interrupted mid-file, so by the time a run actually notices
+// cancellation every candidate has already been renamed or removed.
+func cleanupTempFiles(dir string) {
+        err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+                if err != nil || info.IsDir() {
+                        return nil
+                }
+                if strings.Contains(filepath.Base(path), ".tmp-") {
+                        if *verboseFlag {
+                                logger.Printf("Removing leftover temp file %q", path)
+                        }
+                        os.Remove(path)
+                }
+                return nil
+        })
+        if err != nil {
+                logger.Printf("Error cleaning up temp files under %q: %v", dir, err)
+        }
+}
+
+// trainZstdDict samples the files under dir matching types (bounded to
+// maxDictSamples files via reservoir sampling, so memory use doesn't
+// scale with corpus size), trains a zstd dictionary from them, and
+// writes it to outpath.
+//
+// github.com/DataDog/zstd exposes no dictionary-training API (it only
+// wraps the compress/decompress side of libzstd), so training shells
+// out to the zstd CLI's "--train" mode, which calls the same ZDICT_*
+// routines the library itself has no binding for.
+func trainZstdDict(dir string, types []string, outpath string) {
+        const maxDictSamples = 1000
+        const dictCapacity = 112640 // zstd's recommended default dictionary size
+
+        if _, err := exec.LookPath("zstd"); err != nil {
+                logger.Fatalf("--zstd_train_dict needs the zstd CLI on $PATH to train with: %v", err)
+        }
+
+        sampleDir, err := os.MkdirTemp("", "incremental-compress-dict-samples-")
+        if err != nil {
+                logger.Fatalf("Could not create temp dir for dictionary samples: %v", err)
+        }
+        defer os.RemoveAll(sampleDir)
+
+        var samplePaths []string
+        seen := 0
+
+        err = filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+                if err != nil || info.IsDir() {
+                        return nil
+                }
+                matched := false
+                for _, fileType := range types {
+                        if strings.HasSuffix(path, "."+fileType) {
+                                matched = true
+                                break
+                        }
+                }
+                if !matched {
+                        return nil
+                }
+
+                seen++
+                var slot int
+                if len(samplePaths) < maxDictSamples {
+                        slot = len(samplePaths)
+                        samplePaths = append(samplePaths, "")
+                } else if i := rand.Intn(seen); i < maxDictSamples {
+                        slot = i
+                } else {
+                        return nil
+                }
+
+                samplePath := filepath.Join(sampleDir, strconv.Itoa(seen))
+                if err := copyFile(samplePath, path); err != nil {
+                        logger.Printf("Skipping %q while sampling: %v", path, err)
+                        samplePaths = samplePaths[:len(samplePaths)-1]
+                        return nil
+                }
+                if samplePaths[slot] != "" {
+                        os.Remove(samplePaths[slot])
+                }
+                samplePaths[slot] = samplePath
+                return nil
+        })
+        if err != nil {
+                panic(err)
+        }
+
+        if len(samplePaths) == 0 {
+                logger.Fatalf("No files under %q matched --types; nothing to train a dictionary from", dir)
+        }
+
+        dictTmp := filepath.Join(sampleDir, "dict")
+        args := append([]string{"--train"}, samplePaths...)
+        args = append(args, "-o", dictTmp, fmt.Sprintf("--maxdict=%d", dictCapacity))
+        cmd := exec.Command("zstd", args...)
+        cmd.Stderr = os.Stderr
+        if err := cmd.Run(); err != nil {
+                logger.Fatalf("Could not train zstd dictionary: %v", err)
+        }
+
+        dict, err := os.ReadFile(dictTmp)
+        if err != nil {
+                logger.Fatalf("Could not read trained zstd dictionary: %v", err)
+        }
+
+        if err := os.WriteFile(outpath, dict, 0644); err != nil {
+                logger.Fatalf("Could not write zstd dictionary to %q: %v", outpath, err)
+        }
+
+        logger.Printf("Wrote %d-byte zstd dictionary trained on %d of %d samples to %q", len(dict), len(samplePaths), seen, outpath)
+}
+
+// copyFile copies src's content to dst, creating dst if necessary.
+func copyFile(dst, src string) error {
+        in, err := os.Open(src)
+        if err != nil {
+                return err
+        }
+        defer in.Close()
+        out, err := os.Create(dst)
+        if err != nil {
+                return err
+        }
+        defer out.Close()
+        _, err = io.Copy(out, in)
+        return err
+}
+
+func maybeCompressFile(pool *CompressorPool, conn *sqlite.Conn, path string, info fs.FileInfo) error {
+        forceRecompress, checksum := checkSourceFile(conn, path, info)
+        info, _ = os.Stat(path)
+
+        for _, name := range pool.Codecs() {
+                force := forceRecompress || pool.Forced(name)
+                if !force && !checkCompressedFile(pool.ctx, pool.sink, path, info, pool.Extension(name)) {
+                        continue
+                }
+                if !force && shouldSkipCompression(conn, path, name, checksum) {
+                        continue
+                }
+                pool.Enqueue(name, path, info, checksum)
         }
         return nil
 }
 
-func writeStatusMessage() {
-        if !*quietFlag {
-                fmt.Fprintf(os.Stderr, "%s, %d compressed files updated, %d source files queued to compress, %d checked so far           \r", state, compressedFileUpdateCount, pendingFileCount, totalFileCount)
+// Progress reports on the run as it happens: a per-file event each time
+// a compression job finishes (or is skipped), and periodic overall
+// status. Implementations must be safe to call from multiple compressor
+// workers concurrently.
+type Progress interface {
+        // FileDone reports that codec finished with path: in/out are the
+        // uncompressed/compressed sizes in bytes (when skipped, out is
+        // the size of the discarded candidate, or 0 if the file was
+        // skipped before compressing), and duration is how long the
+        // attempt took.
+        FileDone(codec, path string, in, out int64, duration time.Duration, skipped bool)
+        // Tick renders the current overall status; called periodically
+        // from a dedicated goroutine.
+        Tick()
+        // Close finalizes progress output once all work is done.
+        Close()
+}
+
+// newProgress builds the Progress implementation named by style: "tty"
+// (default interactive renderer), "json" (newline-delimited JSON events
+// for machine consumption), or "silent".
+func newProgress(style string) Progress {
+        switch style {
+        case "json":
+                return &jsonProgress{encoder: json.NewEncoder(os.Stdout)}
+        case "silent":
+                return silentProgress{}
+        default:
+                return &ttyProgress{}
+        }
+}
+
+// ttyProgress renders a single self-overwriting status line to stderr,
+// the way this tool always has; unusable when piped or run from CI, but
+// fine for an interactive terminal. It also accumulates bytes in/out
+// across finished files, so the status line can show running space
+// savings instead of just a count of files touched.
+type ttyProgress struct {
+        mu       sync.Mutex
+        bytesIn  int64
+        bytesOut int64
+}
+
+func (p *ttyProgress) FileDone(codec, path string, in, out int64, duration time.Duration, skipped bool) {
+        if skipped {
+                return
+        }
+        p.mu.Lock()
+        p.bytesIn += in
+        p.bytesOut += out
+        p.mu.Unlock()
+}
+
+func (p *ttyProgress) Tick() {
+        p.mu.Lock()
+        bytesIn, bytesOut := p.bytesIn, p.bytesOut
+        p.mu.Unlock()
+
+        ratio := 0.0
+        if bytesIn > 0 {
+                ratio = 100 * (1 - float64(bytesOut)/float64(bytesIn))
+        }
+        fmt.Fprintf(os.Stderr, "%s, %d compressed files updated, %d source files queued to compress, %d checked so far, %s saved (%.1f%%)           \r", state, compressedFileUpdateCount, pendingFileCount, totalFileCount, formatBytes(bytesIn-bytesOut), ratio)
+}
+
+func (p *ttyProgress) Close() {
+        p.Tick()
+        fmt.Fprintf(os.Stderr, "\n")
+}
+
+// formatBytes renders n bytes as a short human-readable size (e.g.
+// "12.3MB"), for status lines where a raw byte count is hard to read.
+func formatBytes(n int64) string {
+        const unit = 1024
+        if n < unit {
+                return fmt.Sprintf("%dB", n)
+        }
+        div, exp := int64(unit), 0
+        for v := n / unit; v >= unit; v /= unit {
+                div *= unit
+                exp++
+        }
+        return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressEvent is the shape of each line emitted by jsonProgress.
+type progressEvent struct {
+        Event      string `json:"event"`
+        Path       string `json:"path"`
+        Codec      string `json:"codec"`
+        In         int64  `json:"in"`
+        Out        int64  `json:"out"`
+        Skipped    bool   `json:"skipped,omitempty"`
+        DurationMs int64  `json:"duration_ms"`
+}
+
+// jsonProgress emits one JSON line per finished file, for CI logs or
+// other tooling to consume; encoder writes are serialized with a mutex
+// since FileDone is called concurrently from multiple workers.
+type jsonProgress struct {
+        mu      sync.Mutex
+        encoder *json.Encoder
+}
+
+func (p *jsonProgress) FileDone(codec, path string, in, out int64, duration time.Duration, skipped bool) {
+        event := "compressed"
+        if skipped {
+                event = "skipped"
         }
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        p.encoder.Encode(progressEvent{
+                Event:      event,
+                Path:       path,
+                Codec:      codec,
+                In:         in,
+                Out:        out,
+                Skipped:    skipped,
+                DurationMs: duration.Milliseconds(),
+        })
+}
+
+func (*jsonProgress) Tick()  {}
+func (*jsonProgress) Close() {}
+
+// silentProgress reports nothing, for --quiet or non-interactive runs
+// that don't want machine-readable output either.
+type silentProgress struct{}
+
+func (silentProgress) FileDone(codec, path string, in, out int64, duration time.Duration, skipped bool) {
+}
+func (silentProgress) Tick()  {}
+func (silentProgress) Close() {}
+
+// countingWriter wraps an io.Writer to track how many bytes have passed
+// through it, so compressed-size progress can be reported without a
+// separate stat call.
+type countingWriter struct {
+        w io.Writer
+        n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+        n, err := c.w.Write(p)
+        c.n += int64(n)
+        return n, err
 }
 
-func printStatus() {
+func progressLoop(p Progress) {
         for {
-                writeStatusMessage()
+                p.Tick()
                 time.Sleep(50 * time.Millisecond)
         }
 }
 
+// codecOptsFromFlags builds the CompressorOptions for --codec,
+// defaulting to gzip+zstd+brotli at their default levels if none were
+// given.
+func codecOptsFromFlags() []CompressorOption {
+        if len(codecsFlag) == 0 {
+                codecsFlag = codecList{{name: "gzip"}, {name: "zstd"}, {name: "brotli"}}
+        }
+        opts := make([]CompressorOption, len(codecsFlag))
+        for i, c := range codecsFlag {
+                opts[i] = WithCodec(c.name, c.level)
+        }
+        return opts
+}
+
+// resolveCodecs returns the Compressor for each enabled --codec (or
+// gzip/zstd/brotli if none were given), for subcommands that need to
+// look codecs up by name without starting a CompressorPool.
+func resolveCodecs() map[string]Compressor {
+        list := codecsFlag
+        if len(list) == 0 {
+                list = codecList{{name: "gzip"}, {name: "zstd"}, {name: "brotli"}}
+        }
+        out := make(map[string]Compressor, len(list))
+        for _, c := range list {
+                comp, ok := registry[c.name]
+                if !ok {
+                        logger.Fatalf("Unknown codec %q", c.name)
+                }
+                out[c.name] = comp
+        }
+        return out
+}
+
+// loadZstdDict registers a dictionary-aware zstdCompressor for
+// --zstd_dict, if set, so every subcommand's view of the "zstd" codec
+// (compress, watch, and verify, which all resolve codecs from the
+// shared registry) agrees on whether a dictionary is in play. Returns
+// whether the dictionary differs from the one recorded for a previous
+// run, meaning existing zstd output is stale and should be forced to
+// recompress.
+func loadZstdDict(conn *sqlite.Conn) bool {
+        if *zstdDictFlag == "" {
+                return false
+        }
+        dict, err := os.ReadFile(*zstdDictFlag)
+        if err != nil {
+                logger.Fatalf("Could not read zstd dictionary %q: %v", *zstdDictFlag, err)
+        }
+        RegisterCompressor(zstdCompressor{dict: dict})
+        changed := dictChanged(conn, "zstd", dict)
+        if !*quietFlag {
+                logger.Printf("Using zstd dictionary %q for .zst output", *zstdDictFlag)
+        }
+        return changed
+}
+
+// runCompress performs a single compress-everything-under-dir pass and
+// returns. This is the historical (and still default) behavior.
+func runCompress(conn *sqlite.Conn, sink Sink, forceZstd bool) {
+        progressStyle := *progressFlag
+        if *quietFlag {
+                progressStyle = "silent"
+        }
+        prog := newProgress(progressStyle)
+        go progressLoop(prog)
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+
+        sigCh := make(chan os.Signal, 1)
+        signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+        go func() {
+                sig := <-sigCh
+                logger.Printf("Received %s, finishing in-flight jobs and exiting", sig)
+                cancel()
+        }()
+
+        pool := NewCompressorPool(ctx, *concurrencyFlag, conn, prog, sink, codecOptsFromFlags()...)
+        if forceZstd {
+                pool.Force("zstd")
+        }
+        pool.Start(*concurrencyFlag)
+
+        state = "Finding files"
+        err := filepath.Walk(*dirFlag, func(path string, info fs.FileInfo, err error) error { walkFile(pool, conn, path, info, err); return nil })
+        if err != nil {
+                panic(err)
+        }
+        state = "Compressing"
+
+        pool.Close()
+
+        if ctx.Err() != nil {
+                setFailure()
+        }
+
+        state = "Exiting"
+
+        prog.Close()
+
+        if failure {
+                os.Exit(1)
+        }
+}
+
+// runWatch behaves like runCompress, except instead of exiting after
+// one pass it keeps the pool and SQLite state hot and recompresses
+// files as fsnotify reports them changing, until interrupted. Because
+// the same CompressorPool lives for the life of the process, codecs
+// implementing PoolableCompressor (brotli, gzip) reuse their writers
+// across files instead of allocating one per compression.
+func runWatch(conn *sqlite.Conn, sink Sink, forceZstd bool) {
+        progressStyle := *progressFlag
+        if *quietFlag {
+                progressStyle = "silent"
+        }
+        prog := newProgress(progressStyle)
+        go progressLoop(prog)
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+
+        sigCh := make(chan os.Signal, 1)
+        signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+        go func() {
+                sig := <-sigCh
+                logger.Printf("Received %s, shutting down", sig)
+                cancel()
+        }()
+
+        pool := NewCompressorPool(ctx, *concurrencyFlag, conn, prog, sink, codecOptsFromFlags()...)
+        if forceZstd {
+                pool.Force("zstd")
+        }
+        pool.Start(*concurrencyFlag)
+
+        watcher, err := fsnotify.NewWatcher()
+        if err != nil {
+                logger.Fatalf("Could not start file watcher: %v", err)
+        }
+        defer watcher.Close()
+
+        state = "Finding files"
+        err = filepath.Walk(*dirFlag, func(path string, info fs.FileInfo, err error) error {
+                if err != nil {
+                        return nil
+                }
+                if info.IsDir() {
+                        if err := watcher.Add(path); err != nil {
+                                logger.Printf("Could not watch %q: %v", path, err)
+                        }
+                        return nil
+                }
+                return walkFile(pool, conn, path, info, err)
+        })
+        if err != nil {
+                panic(err)
+        }
+
+        state = "Watching " + *dirFlag
+        if !*quietFlag {
+                logger.Printf("Watching %q for changes", *dirFlag)
+        }
+
+        for {
+                select {
+                case <-ctx.Done():
+                        pool.Close()
+                        prog.Close()
+                        return
+
+                case err, ok := <-watcher.Errors:
+                        if !ok {
+                                continue
+                        }
+                        logger.Printf("Watcher error: %v", err)
+
+                case event, ok := <-watcher.Events:
+                        if !ok {
+                                continue
+                        }
+                        if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+                                continue
+                        }
+
+                        info, err := os.Stat(event.Name)
+                        if err != nil {
+                                continue // vanished before we got to it
+                        }
+                        if info.IsDir() {
+                                if event.Op&fsnotify.Create != 0 {
+                                        if err := watcher.Add(event.Name); err != nil {
+                                                logger.Printf("Could not watch %q: %v", event.Name, err)
+                                        }
+                                }
+                                continue
+                        }
+                        if isCompressableType(event.Name) {
+                                foundFile()
+                                maybeCompressFile(pool, conn, event.Name, info)
+                        }
+                }
+        }
+}
+
+// runVerify walks the source tree and, for every enabled codec,
+// confirms that decompressing path+extension (read back through sink,
+// wherever it actually lives) reproduces content matching the source's
+// checksum in the state DB. Returns the number of files that failed to
+// verify.
+func runVerify(conn *sqlite.Conn, sink Sink) int {
+        if conn == nil {
+                logger.Fatalf("verify needs --statedir")
+        }
+
+        compressors := resolveCodecs()
+        checked, bad := 0, 0
+        ctx := context.Background()
+
+        err := filepath.Walk(*dirFlag, func(p string, info fs.FileInfo, err error) error {
+                if err != nil || info.IsDir() || !isCompressableType(p) {
+                        return nil
+                }
+                _, checksum := checkSourceFile(conn, p, info)
+
+                for name, c := range compressors {
+                        compressedPath := p + c.Extension()
+                        cf, err := sink.Open(ctx, compressedPath)
+                        if err != nil {
+                                continue // nothing compressed with this codec to verify
+                        }
+
+                        reader, err := c.NewReader(cf)
+                        if err != nil {
+                                logger.Printf("verify: %s %q: %v", name, compressedPath, err)
+                                cf.Close()
+                                bad++
+                                continue
+                        }
+
+                        sha := sha1.New()
+                        _, copyErr := io.Copy(sha, reader)
+                        reader.Close()
+                        cf.Close()
+                        checked++
+
+                        if copyErr != nil {
+                                logger.Printf("verify: %s %q: could not decompress: %v", name, compressedPath, copyErr)
+                                bad++
+                                continue
+                        }
+                        if got := fmt.Sprintf("%x", sha.Sum(nil)); got != checksum {
+                                logger.Printf("verify: %s %q: decompressed content doesn't match %q", name, compressedPath, p)
+                                bad++
+                        }
+                }
+                return nil
+        })
+        if err != nil {
+                logger.Fatalf("%v", err)
+        }
+
+        if !*quietFlag {
+                logger.Printf("Verified %d compressed file(s), %d mismatch(es)", checked, bad)
+        }
+        return bad
+}
+
+// runPrune removes compressed outputs, for every enabled codec, whose
+// source file no longer exists. Enumerates via sink.List rather than
+// walking --dir directly, since with a remote --dest the compressed
+// outputs don't live in the local tree at all.
+func runPrune(conn *sqlite.Conn, sink Sink) int {
+        compressors := resolveCodecs()
+        removed := 0
+        ctx := context.Background()
+
+        entries, err := sink.List(ctx, *dirFlag)
+        if err != nil {
+                logger.Fatalf("prune: could not list %q: %v", *dirFlag, err)
+        }
+
+        for _, p := range entries {
+                for name, c := range compressors {
+                        ext := c.Extension()
+                        if !strings.HasSuffix(p, ext) {
+                                continue
+                        }
+                        source := strings.TrimSuffix(p, ext)
+                        if _, err := os.Stat(source); !os.IsNotExist(err) {
+                                continue
+                        }
+
+                        if !*quietFlag {
+                                logger.Printf("prune: removing orphaned %s output %q (source %q is gone)", name, p, source)
+                        }
+                        if err := sink.Delete(ctx, p); err != nil {
+                                logger.Printf("prune: could not remove %q: %v", p, err)
+                                continue
+                        }
+                        clearSkipCompression(conn, source, name)
+                        removed++
+                }
+        }
+
+        if !*quietFlag {
+                logger.Printf("Removed %d orphaned compressed file(s)", removed)
+        }
+        return removed
+}
+
+// runStats reports cumulative bytes saved per codec, as recorded by
+// recordStats across every run against this --statedir.
+func runStats(conn *sqlite.Conn) {
+        if conn == nil {
+                logger.Fatalf("stats needs --statedir")
+        }
+
+        type codecStats struct {
+                files             int64
+                bytesIn, bytesOut int64
+        }
+        stats := map[string]codecStats{}
+
+        connMutex.Lock()
+        err := sqlitex.ExecuteTransient(
+                conn,
+                "select codec, files, bytes_in, bytes_out from statsstate;",
+                &sqlitex.ExecOptions{
+                        ResultFunc: func(stmt *sqlite.Stmt) error {
+                                stats[stmt.GetText("codec")] = codecStats{
+                                        files:    stmt.GetInt64("files"),
+                                        bytesIn:  stmt.GetInt64("bytes_in"),
+                                        bytesOut: stmt.GetInt64("bytes_out"),
+                                }
+                                return nil
+                        },
+                },
+        )
+        connMutex.Unlock()
+        if err != nil {
+                panic(err)
+        }
+
+        var totalIn, totalOut int64
+        for name, s := range stats {
+                fmt.Printf("%-8s %8d files  %14d -> %-14d bytes (%d saved)\n", name, s.files, s.bytesIn, s.bytesOut, s.bytesIn-s.bytesOut)
+                totalIn += s.bytesIn
+                totalOut += s.bytesOut
+        }
+        fmt.Printf("%-8s %8s %14d -> %-14d bytes (%d saved)\n", "total", "", totalIn, totalOut, totalIn-totalOut)
+}
+
 func main() {
-        flag.Parse()
+        cmd, rest := "compress", os.Args[1:]
+        switch {
+        case len(rest) > 0 && rest[0] == "watch":
+                cmd, rest = "watch", rest[1:]
+        case len(rest) > 0 && rest[0] == "verify":
+                cmd, rest = "verify", rest[1:]
+        case len(rest) > 0 && rest[0] == "prune":
+                cmd, rest = "prune", rest[1:]
+        case len(rest) > 0 && rest[0] == "stats":
+                cmd, rest = "stats", rest[1:]
+        case len(rest) > 0 && rest[0] == "compress":
+                cmd, rest = "compress", rest[1:]
+        }
+        flag.CommandLine.Parse(rest)
+
         types = strings.Split(*typesFlag, ",")
         logger = log.New(os.Stderr, "", 0)
 
@@ -397,27 +1893,55 @@ func main() {
                         panic(err)
                 }
 
-        }
+                err = sqlitex.ExecuteScript(conn, `CREATE TABLE IF NOT EXISTS skipstate ( filename text, codec text, checksum text, primary key (filename, codec) )`, &sqlitex.ExecOptions{})
+                if err != nil {
+                        panic(err)
+                }
 
-        go printStatus()
+                err = sqlitex.ExecuteScript(conn, `CREATE TABLE IF NOT EXISTS dictstate ( codec text primary key, sha text )`, &sqlitex.ExecOptions{})
+                if err != nil {
+                        panic(err)
+                }
 
-        state = "Finding files"
-        err = filepath.Walk(*dirFlag, func(path string, info fs.FileInfo, err error) error { walkFile(conn, path, info, err); return nil })
-        if err != nil {
-                panic(err)
+                err = sqlitex.ExecuteScript(conn, `CREATE TABLE IF NOT EXISTS statsstate ( codec text primary key, files int, bytes_in int, bytes_out int )`, &sqlitex.ExecOptions{})
+                if err != nil {
+                        panic(err)
+                }
         }
-        state = "Compressing"
 
-        wg.Wait()
+        if *zstdTrainDictFlag != "" {
+                trainZstdDict(*dirFlag, types, *zstdTrainDictFlag)
+                return
+        }
 
-        state = "Exiting"
+        // Sweep before any subcommand walks *dirFlag, so temp files left
+        // behind by a prior crash are gone before compress/watch/verify/
+        // prune see them, rather than relying on a later run's graceful
+        // shutdown path to notice them (it never will).
+        cleanupTempFiles(*dirFlag)
 
-        if failure {
-                os.Exit(1)
+        // Loaded once, here, so every subcommand's "zstd" codec (looked
+        // up from the shared registry by codecOptsFromFlags/
+        // resolveCodecs) agrees on whether a dictionary is in play.
+        forceZstd := loadZstdDict(conn)
+
+        sink, err := parseSink(*destFlag)
+        if err != nil {
+                logger.Fatalf("%v", err)
         }
 
-        if !*quietFlag {
-                writeStatusMessage()
-                fmt.Fprintf(os.Stderr, "\n")
+        switch cmd {
+        case "watch":
+                runWatch(conn, sink, forceZstd)
+        case "verify":
+                if runVerify(conn, sink) > 0 {
+                        os.Exit(1)
+                }
+        case "prune":
+                runPrune(conn, sink)
+        case "stats":
+                runStats(conn)
+        default:
+                runCompress(conn, sink, forceZstd)
         }
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+        "path/filepath"
+        "testing"
+
+        "zombiezen.com/go/sqlite"
+        "zombiezen.com/go/sqlite/sqlitex"
+)
+
+// openTestStateDB creates a fresh skipstate table in a temp-file sqlite
+// DB, mirroring the schema main() creates for --statedir.
+func openTestStateDB(t *testing.T) *sqlite.Conn {
+        t.Helper()
+        conn, err := sqlite.OpenConn(filepath.Join(t.TempDir(), "state.db"))
+        if err != nil {
+                t.Fatalf("OpenConn: %v", err)
+        }
+        t.Cleanup(func() { conn.Close() })
+
+        err = sqlitex.ExecuteScript(conn, `CREATE TABLE IF NOT EXISTS skipstate ( filename text, codec text, checksum text, primary key (filename, codec) )`, &sqlitex.ExecOptions{})
+        if err != nil {
+                t.Fatalf("creating skipstate: %v", err)
+        }
+        return conn
+}
+
+// TestSkipCompressionStateMachine exercises the mark/should-skip/clear
+// cycle doCompress uses to remember, across runs, that a file doesn't
+// compress well enough with a given codec at a given checksum.
+func TestSkipCompressionStateMachine(t *testing.T) {
+        conn := openTestStateDB(t)
+
+        if shouldSkipCompression(conn, "a.js", "gzip", "checksum1") {
+                t.Fatalf("shouldSkipCompression reported true before anything was marked")
+        }
+
+        markSkipCompression(conn, "a.js", "gzip", "checksum1")
+        if !shouldSkipCompression(conn, "a.js", "gzip", "checksum1") {
+                t.Fatalf("shouldSkipCompression reported false right after marking")
+        }
+
+        // A different checksum for the same file (i.e. the source changed)
+        // must not still be skipped.
+        if shouldSkipCompression(conn, "a.js", "gzip", "checksum2") {
+                t.Fatalf("shouldSkipCompression reported true for a different checksum")
+        }
+
+        // A different codec for the same file/checksum is independent.
+        if shouldSkipCompression(conn, "a.js", "brotli", "checksum1") {
+                t.Fatalf("shouldSkipCompression reported true for a different codec")
+        }
+
+        clearSkipCompression(conn, "a.js", "gzip")
+        if shouldSkipCompression(conn, "a.js", "gzip", "checksum1") {
+                t.Fatalf("shouldSkipCompression still reported true after clearing")
+        }
+}
+
+// TestSkipCompressionStateMachineNilConn mirrors runs without
+// --statedir, where there's nowhere to persist skip state, so nothing
+// should ever be skipped.
+func TestSkipCompressionStateMachineNilConn(t *testing.T) {
+        markSkipCompression(nil, "a.js", "gzip", "checksum1")
+        if shouldSkipCompression(nil, "a.js", "gzip", "checksum1") {
+                t.Fatalf("shouldSkipCompression reported true with a nil conn")
+        }
+}